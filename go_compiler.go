@@ -1,10 +1,12 @@
 package tempilegocompiler
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"go/format"
 	"slices"
+	"strconv"
 	"strings"
 
 	tempilecore "github.com/gokhanaltun/tempile-core"
@@ -15,17 +17,146 @@ type CompileOptions struct {
 	TemplateName string
 	FileName     string
 	SrcPath      string
+	// FragmentPrefix namespaces the generated _frag_ package vars of the
+	// template body so multiple templates compiled into the same package
+	// don't collide. Component fragments (_frag_component_<Name>_<n>) and
+	// _component_<Name> functions are named after the component alone and do
+	// not take the prefix.
+	FragmentPrefix string
 }
 
 type codeChunk struct {
 	Writable bool
 	NoMerge  bool
 	Data     string
+	Pos      tempilecore.Pos
+}
+
+// SourceMap maps a generated-Go line number back to the Pos in the original
+// template it was compiled from. Built by CompileWithSourceMap from the
+// "//line" directives left in the formatted output.
+type SourceMap struct {
+	entries map[int]tempilecore.Pos
+}
+
+// Lookup returns the template Pos that produced genLine, if any.
+func (sm *SourceMap) Lookup(genLine int) (tempilecore.Pos, bool) {
+	pos, ok := sm.entries[genLine]
+	return pos, ok
+}
+
+func (sm *SourceMap) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sm.entries)
+}
+
+// escContext tracks where an ExprNode is being emitted so it can be routed
+// through the matching tempileruntime escape helper.
+type escContext int
+
+const (
+	escCtxHTML escContext = iota
+	escCtxAttr
+	escCtxURL
+	escCtxSrcset
+	escCtxJS
+	escCtxCSS
+)
+
+// urlAttrs are the attributes whose value is a single URL, and therefore
+// need escCtxURL instead of the plain escCtxAttr treatment.
+var urlAttrs = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"xlink:href": true,
 }
 
 type compileContext struct {
-	usedHTML bool
-	usedFMT  bool
+	usedFMT     bool
+	usedRuntime bool
+	escStack    []escContext
+	// params holds the typed parameter list declared by a "tempile:params"
+	// directive, in source order. Empty means the template still takes the
+	// default "data map[string]any" parameter.
+	params []paramDecl
+	// components holds every "tempile:component" declaration seen anywhere
+	// in the template (including included files), keyed by name.
+	// componentOrder preserves the order they were first declared in, so
+	// codegen doesn't depend on map iteration order.
+	components     map[string]*componentDecl
+	componentOrder []string
+	// inComponentBody is true while compileComponents is rendering a
+	// component's own declared body, so a "tempile:slot" found there is
+	// accepted and one found anywhere else is rejected.
+	inComponentBody bool
+}
+
+// componentDecl is a collected "tempile:component" declaration: its name,
+// declared parameter list and body, available for lookup by every
+// "<Name/>"/"tempile:call" site regardless of where it appears relative to
+// the declaration. HasSlot records whether the body contains a
+// "tempile:slot" placeholder, which decides whether the generated function
+// takes the extra slot-rendering parameter.
+type componentDecl struct {
+	Name    string
+	Params  []paramDecl
+	Childs  []tempilecore.Node
+	HasSlot bool
+	Pos     tempilecore.Pos
+}
+
+// paramDecl is one "name type" pair parsed out of a "tempile:params" go
+// attribute, e.g. {"user", "*User"}.
+type paramDecl struct {
+	Name string
+	Type string
+}
+
+// FieldName is the exported struct field name for a param, used when
+// generating the companion Params struct (e.g. "user" -> "User").
+func (p paramDecl) FieldName() string {
+	if p.Name == "" {
+		return p.Name
+	}
+	return strings.ToUpper(p.Name[:1]) + p.Name[1:]
+}
+
+// hasParams reports whether a "tempile:params" directive was seen, switching
+// the generated function from map-mode to a typed parameter list.
+func (c *compileContext) hasParams() bool {
+	return c.params != nil
+}
+
+// signature renders the declared params as a Go parameter list, e.g.
+// "user *User, items []Item, now time.Time".
+func (c *compileContext) signature() string {
+	return renderParamList(c.params)
+}
+
+// renderParamList renders params as a Go function parameter list, e.g.
+// "title string, body string".
+func renderParamList(params []paramDecl) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = fmt.Sprintf("%s %s", p.Name, p.Type)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (c *compileContext) pushEsc(ec escContext) {
+	c.escStack = append(c.escStack, ec)
+}
+
+func (c *compileContext) popEsc() {
+	c.escStack = c.escStack[:len(c.escStack)-1]
+}
+
+func (c *compileContext) currentEsc() escContext {
+	if len(c.escStack) == 0 {
+		return escCtxHTML
+	}
+	return c.escStack[len(c.escStack)-1]
 }
 
 type importCtx struct {
@@ -47,24 +178,35 @@ var voidElements = map[string]bool{
 }
 
 func Compile(src string, options *CompileOptions) (string, error) {
+	code, _, err := compile(src, options)
+	return code, err
+}
+
+// CompileWithSourceMap compiles src like Compile, additionally returning a
+// SourceMap that maps generated-Go line numbers back to positions in src.
+func CompileWithSourceMap(src string, options *CompileOptions) (string, *SourceMap, error) {
+	return compile(src, options)
+}
+
+func compile(src string, options *CompileOptions) (string, *SourceMap, error) {
 	if options == nil {
-		return "", errors.New("missing compile options")
+		return "", nil, errors.New("missing compile options")
 	}
 
 	if options.PackageName == "" {
-		return "", errors.New("missing package name in compile options")
+		return "", nil, errors.New("missing package name in compile options")
 	}
 
 	if options.TemplateName == "" {
-		return "", errors.New("missing template name in compile options")
+		return "", nil, errors.New("missing template name in compile options")
 	}
 
 	if options.FileName == "" {
-		return "", errors.New("missing file name in compile options")
+		return "", nil, errors.New("missing file name in compile options")
 	}
 
 	if options.SrcPath == "" {
-		return "", errors.New("missing src path in compile options")
+		return "", nil, errors.New("missing src path in compile options")
 	}
 
 	layout := `
@@ -74,9 +216,11 @@ func Compile(src string, options *CompileOptions) (string, error) {
 		%s
 	)
 
-	func %s(w io.Writer, data map[string]any) error {
+	%s
+
+	func %s(w io.Writer, %s) error {
 		var err error
-		
+
 		%s
 
 		return err
@@ -85,7 +229,7 @@ func Compile(src string, options *CompileOptions) (string, error) {
 
 	ast, err := tempilecore.Parse(src, options.FileName)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	ast.ResolveIncludes(options.SrcPath)
@@ -94,11 +238,15 @@ func Compile(src string, options *CompileOptions) (string, error) {
 	ctx := &compileContext{}
 	impCtx := &importCtx{}
 
+	if err := collectComponents(ast.Childs, ctx); err != nil {
+		return "", nil, err
+	}
+
 	var codeChunks []*codeChunk
 	for _, node := range ast.Childs {
 		chunks, err := parseNode(node, ctx, impCtx)
 		if err != nil {
-			return "", err
+			return "", nil, err
 		}
 		codeChunks = append(codeChunks, chunks...)
 
@@ -106,13 +254,38 @@ func Compile(src string, options *CompileOptions) (string, error) {
 
 	codeChunks = mergeWritableChunks(codeChunks)
 
+	for _, chunk := range codeChunks {
+		if chunk.Writable && chunk.NoMerge {
+			ctx.usedRuntime = true
+			break
+		}
+	}
+
+	var frags strings.Builder
+	if err := compileComponents(ctx, impCtx, &frags); err != nil {
+		return "", nil, err
+	}
+
 	var code strings.Builder
+	fragIndex := 0
 	for _, chunk := range codeChunks {
+		// An "else"/"else if" chunk must stay glued to the preceding "}" on
+		// the same line ("} else {"); a line directive emits on its own
+		// line, so inserting one here would split them and format.Source
+		// would reject the result as "expected statement, found 'else'".
+		if !chunk.Writable && strings.HasPrefix(chunk.Data, "else") {
+			code.WriteString(chunk.Data)
+			continue
+		}
+		code.WriteString(lineDirective(options.FileName, chunk.Pos))
 		if chunk.Writable {
 			if chunk.NoMerge {
-				writeStringLiteral(&code, chunk.Data)
+				code.WriteString(fmt.Sprintf("if err = tempileruntime.WriteString(w, %s); err != nil { return err }\n", chunk.Data))
 			} else {
-				code.WriteString(fmt.Sprintf("if _, err = io.WriteString(w, `%s`); err != nil { return err }\n", chunk.Data))
+				fragName := fmt.Sprintf("_frag_%s%s_%d", options.FragmentPrefix, options.TemplateName, fragIndex)
+				fragIndex++
+				frags.WriteString(fmt.Sprintf("var %s = []byte(%q)\n", fragName, chunk.Data))
+				code.WriteString(fmt.Sprintf("if _, err = w.Write(%s); err != nil { return err }\n", fragName))
 			}
 		} else {
 			code.WriteString(chunk.Data)
@@ -120,30 +293,285 @@ func Compile(src string, options *CompileOptions) (string, error) {
 	}
 
 	imports := ""
-	if ctx.usedHTML {
-		imports += "\t\"html\"\n"
-	}
 	if ctx.usedFMT {
 		imports += "\t\"fmt\"\n"
 	}
+	if ctx.usedRuntime {
+		imports += "\ttempileruntime \"github.com/gokhanaltun/tempile-go-compiler/tempileruntime\"\n"
+	}
 
 	for _, imp := range impCtx.imports {
 		imports += fmt.Sprintf("\t\"%s\"\n", imp)
 	}
 
-	compiledCode := fmt.Sprintf(layout, options.PackageName, imports, options.TemplateName, code.String())
+	paramList := "data map[string]any"
+	if ctx.hasParams() {
+		paramList = ctx.signature()
+		frags.WriteString(paramsDecl(options.TemplateName, ctx.params))
+	}
+
+	compiledCode := fmt.Sprintf(layout, options.PackageName, imports, frags.String(), options.TemplateName, paramList, code.String())
 
 	formattedCode, err := format.Source([]byte(compiledCode))
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+
+	return string(formattedCode), buildSourceMap(string(formattedCode)), nil
+}
+
+// lineDirective renders a "//line file:line:col" comment for pos, or the
+// empty string if pos carries no line (e.g. synthetic chunks). A pos with no
+// file name is reported under fallbackFile instead. go/format
+// preserves these comments, and the Go toolchain honors them afterwards, so
+// panics and runtime.Caller in generated code point back to the template.
+func lineDirective(fallbackFile string, pos tempilecore.Pos) string {
+	file := pos.FileName
+	if file == "" {
+		file = fallbackFile
+	}
+	if pos.Line == 0 {
+		return ""
+	}
+	// The leading newline guarantees the directive starts its own physical
+	// line, which both go/format and buildSourceMap require.
+	return fmt.Sprintf("\n//line %s:%d:%d\n", file, pos.Line, pos.Column)
+}
+
+// paramsDecl renders the companion "<TemplateName>Params" struct and the
+// "<TemplateName>WithParams" wrapper that calls the typed render function
+// from a populated struct, for templates with a "tempile:params" directive.
+func paramsDecl(templateName string, params []paramDecl) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "type %sParams struct {\n", templateName)
+	for _, p := range params {
+		fmt.Fprintf(&b, "%s %s\n", p.FieldName(), p.Type)
+	}
+	b.WriteString("}\n\n")
+
+	args := make([]string, len(params))
+	for i, p := range params {
+		args[i] = fmt.Sprintf("p.%s", p.FieldName())
+	}
+	fmt.Fprintf(&b, "func %sWithParams(w io.Writer, p %sParams) error {\n", templateName, templateName)
+	fmt.Fprintf(&b, "return %s(w, %s)\n}\n", templateName, strings.Join(args, ", "))
+
+	return b.String()
+}
+
+// collectComponents walks the whole template tree registering every
+// "tempile:component" declaration on ctx before the main compile pass runs,
+// so a "<Name/>"/"tempile:call" site resolves regardless of where in the
+// document it appears relative to its declaration. Called after
+// ResolveIncludes, so components declared in included files are picked up
+// too.
+func collectComponents(nodes []tempilecore.Node, ctx *compileContext) error {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *tempilecore.ComponentNode:
+			if _, ok := ctx.components[n.Name]; ok {
+				return fmt.Errorf("duplicate component %q. file: %s line: %d col: %d",
+					n.Name, n.Pos.FileName, n.Pos.Line, n.Pos.Column)
+			}
+
+			params, err := splitParamDecls(n.Params)
+			if err != nil {
+				return fmt.Errorf("invalid params in \"tempile:component\" %q: %s. file: %s line: %d col: %d",
+					n.Name, err, n.Pos.FileName, n.Pos.Line, n.Pos.Column)
+			}
+
+			if ctx.components == nil {
+				ctx.components = map[string]*componentDecl{}
+			}
+			ctx.components[n.Name] = &componentDecl{
+				Name:    n.Name,
+				Params:  params,
+				Childs:  n.Childs,
+				HasSlot: containsSlot(n.Childs),
+				Pos:     n.Pos,
+			}
+			ctx.componentOrder = append(ctx.componentOrder, n.Name)
+
+			if err := collectComponents(n.Childs, ctx); err != nil {
+				return err
+			}
+		case *tempilecore.ElementNode:
+			if err := collectComponents(n.Childs, ctx); err != nil {
+				return err
+			}
+		case *tempilecore.IfNode:
+			if err := collectComponents(n.Then, ctx); err != nil {
+				return err
+			}
+			for _, ei := range n.ElseIfNodes {
+				if err := collectComponents(ei.Childs, ctx); err != nil {
+					return err
+				}
+			}
+			if ec, ok := n.Else.(*tempilecore.ElseNode); ok {
+				if err := collectComponents(ec.Childs, ctx); err != nil {
+					return err
+				}
+			}
+		case *tempilecore.ForNode:
+			if err := collectComponents(n.Childs, ctx); err != nil {
+				return err
+			}
+		case *tempilecore.ComponentCallNode:
+			if err := collectComponents(n.Childs, ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// containsSlot reports whether nodes contains a "tempile:slot" placeholder
+// anywhere in its own body, stopping at a nested "tempile:component"
+// boundary: a slot inside a nested component declaration belongs to that
+// component, not the one being scanned.
+func containsSlot(nodes []tempilecore.Node) bool {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *tempilecore.SlotNode:
+			return true
+		case *tempilecore.ElementNode:
+			if containsSlot(n.Childs) {
+				return true
+			}
+		case *tempilecore.IfNode:
+			if containsSlot(n.Then) {
+				return true
+			}
+			for _, ei := range n.ElseIfNodes {
+				if containsSlot(ei.Childs) {
+					return true
+				}
+			}
+			if ec, ok := n.Else.(*tempilecore.ElseNode); ok && containsSlot(ec.Childs) {
+				return true
+			}
+		case *tempilecore.ForNode:
+			if containsSlot(n.Childs) {
+				return true
+			}
+		case *tempilecore.ComponentCallNode:
+			// A slot placed in the content passed to a nested call forwards
+			// this component's own slot into the callee's, e.g. <B><tempile:slot/></B>.
+			if containsSlot(n.Childs) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compileComponents renders every declaration collected by collectComponents
+// as a standalone "_component_<Name>" function, writing each one (and any
+// fragments it hoists) to frags so they land as package-level declarations
+// alongside the main template function.
+func compileComponents(ctx *compileContext, impCtx *importCtx, frags *strings.Builder) error {
+	for _, name := range ctx.componentOrder {
+		decl := ctx.components[name]
+
+		ctx.inComponentBody = true
+		chunks, err := parseChildNodes(decl.Childs, ctx, impCtx)
+		ctx.inComponentBody = false
+		if err != nil {
+			return err
+		}
+		chunks = mergeWritableChunks(chunks)
+
+		for _, chunk := range chunks {
+			if chunk.Writable && chunk.NoMerge {
+				ctx.usedRuntime = true
+				break
+			}
+		}
+
+		var body strings.Builder
+		fragIndex := 0
+		for _, chunk := range chunks {
+			if chunk.Writable {
+				if chunk.NoMerge {
+					body.WriteString(fmt.Sprintf("if err = tempileruntime.WriteString(w, %s); err != nil { return err }\n", chunk.Data))
+				} else {
+					fragName := fmt.Sprintf("_frag_component_%s_%d", decl.Name, fragIndex)
+					fragIndex++
+					frags.WriteString(fmt.Sprintf("var %s = []byte(%q)\n", fragName, chunk.Data))
+					body.WriteString(fmt.Sprintf("if _, err = w.Write(%s); err != nil { return err }\n", fragName))
+				}
+			} else {
+				body.WriteString(chunk.Data)
+			}
+		}
+
+		params := renderParamList(decl.Params)
+		if decl.HasSlot {
+			if params != "" {
+				params += ", "
+			}
+			params += "tempileSlot func(io.Writer) error"
+		}
+
+		fmt.Fprintf(frags, "func _component_%s(w io.Writer, %s) error {\nvar err error\n\n%s\n\nreturn err\n}\n\n",
+			decl.Name, params, body.String())
+	}
+	return nil
+}
+
+// buildSourceMap re-derives a SourceMap from the "//line" directives left in
+// formatted generated code: per the Go spec, a line directive sets the
+// reported position of the physical line that follows it.
+func buildSourceMap(formatted string) *SourceMap {
+	sm := &SourceMap{entries: make(map[int]tempilecore.Pos)}
+
+	lines := strings.Split(formatted, "\n")
+	for i, line := range lines {
+		pos, ok := parseLineDirective(strings.TrimSpace(line))
+		if !ok {
+			continue
+		}
+		sm.entries[i+2] = pos
+	}
+
+	return sm
+}
+
+// parseLineDirective parses a "//line file:line:col" comment.
+func parseLineDirective(s string) (tempilecore.Pos, bool) {
+	if !strings.HasPrefix(s, "//line ") {
+		return tempilecore.Pos{}, false
+	}
+	s = strings.TrimPrefix(s, "//line ")
+
+	colIdx := strings.LastIndex(s, ":")
+	if colIdx < 0 {
+		return tempilecore.Pos{}, false
+	}
+	col, err := strconv.Atoi(s[colIdx+1:])
+	if err != nil {
+		return tempilecore.Pos{}, false
 	}
+	s = s[:colIdx]
 
-	return string(formattedCode), nil
+	lineIdx := strings.LastIndex(s, ":")
+	if lineIdx < 0 {
+		return tempilecore.Pos{}, false
+	}
+	line, err := strconv.Atoi(s[lineIdx+1:])
+	if err != nil {
+		return tempilecore.Pos{}, false
+	}
+
+	return tempilecore.Pos{FileName: s[:lineIdx], Line: line, Column: col}, true
 }
 
 func mergeWritableChunks(chunks []*codeChunk) []*codeChunk {
 	var merged []*codeChunk
 	var buffer string
+	var bufferPos tempilecore.Pos
 
 	flush := func() {
 		if buffer == "" {
@@ -152,8 +580,10 @@ func mergeWritableChunks(chunks []*codeChunk) []*codeChunk {
 		merged = append(merged, &codeChunk{
 			Writable: true,
 			Data:     buffer,
+			Pos:      bufferPos,
 		})
 		buffer = ""
+		bufferPos = tempilecore.Pos{}
 	}
 
 	for _, c := range chunks {
@@ -164,6 +594,7 @@ func mergeWritableChunks(chunks []*codeChunk) []*codeChunk {
 		if c.Writable && !c.NoMerge {
 			if buffer == "" {
 				buffer = c.Data
+				bufferPos = c.Pos
 			} else {
 				buffer = buffer + c.Data
 			}
@@ -178,24 +609,16 @@ func mergeWritableChunks(chunks []*codeChunk) []*codeChunk {
 	return merged
 }
 
-func writeStringLiteral(w *strings.Builder, s string) {
-	if strings.Contains(s, "`") {
-		w.WriteString(fmt.Sprintf(
-			"if _, err = io.WriteString(w, %q); err != nil { return err }\n",
-			s,
-		))
-	} else {
-		w.WriteString(fmt.Sprintf(
-			"if _, err = io.WriteString(w, `%s`); err != nil { return err }\n",
-			s,
-		))
-	}
-}
-
 func parseNode(node tempilecore.Node, ctx *compileContext, impCtx *importCtx) ([]*codeChunk, error) {
 	switch node.Type() {
 	case tempilecore.NodeImport:
 		return []*codeChunk{parseImportNode(node, impCtx)}, nil
+	case tempilecore.NodeParams:
+		chunk, err := parseParamsNode(node, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []*codeChunk{chunk}, nil
 	case tempilecore.NodeDocumentType:
 		return []*codeChunk{parseDocumentTypeNode(node)}, nil
 	case tempilecore.NodeComment:
@@ -209,11 +632,39 @@ func parseNode(node tempilecore.Node, ctx *compileContext, impCtx *importCtx) ([
 	case tempilecore.NodeFor:
 		return parseForNode(node, ctx, impCtx)
 	case tempilecore.NodeRawCode:
-		return []*codeChunk{parseRawCodeNode(node)}, nil
+		chunk, err := parseRawCodeNode(node)
+		if err != nil {
+			return nil, err
+		}
+		return []*codeChunk{chunk}, nil
 	case tempilecore.NodeRawExpr:
-		return []*codeChunk{parseRawExprNode(node)}, nil
+		chunk, err := parseRawExprNode(node)
+		if err != nil {
+			return nil, err
+		}
+		return []*codeChunk{chunk}, nil
 	case tempilecore.NodeExpr:
-		return []*codeChunk{parseExprNode(node, ctx)}, nil
+		chunk, err := parseExprNode(node, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []*codeChunk{chunk}, nil
+	case tempilecore.NodeComponent:
+		// Declarations carry no output of their own; collectComponents
+		// already recorded this node before the main walk started.
+		return nil, nil
+	case tempilecore.NodeComponentCall:
+		chunk, err := parseComponentCallNode(node, ctx, impCtx)
+		if err != nil {
+			return nil, err
+		}
+		return []*codeChunk{chunk}, nil
+	case tempilecore.NodeSlot:
+		chunk, err := parseSlotNode(node, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []*codeChunk{chunk}, nil
 	default:
 		return nil, nil
 	}
@@ -230,11 +681,254 @@ func parseImportNode(node tempilecore.Node, impCtx *importCtx) *codeChunk {
 	return nil
 }
 
+// parseParamsNode handles a "tempile:params" directive, recording the
+// declared parameter list on ctx so compile can switch the generated
+// function from map-mode to a typed signature. Like parseImportNode, it
+// never produces a codeChunk of its own.
+func parseParamsNode(node tempilecore.Node, ctx *compileContext) (*codeChunk, error) {
+	paramsNode := node.(*tempilecore.ParamsNode)
+
+	var raw string
+	for _, a := range paramsNode.Attrs {
+		if a.Name == "go" {
+			raw = a.Value
+			break
+		}
+	}
+
+	if raw == "" {
+		return nil, fmt.Errorf("missing go attribute in \"tempile:params\" element. file: %s line: %d col: %d",
+			paramsNode.Pos.FileName, paramsNode.Pos.Line, paramsNode.Pos.Column)
+	}
+
+	if err := validateGoParams(raw, paramsNode.Pos); err != nil {
+		return nil, err
+	}
+
+	decls, err := splitParamDecls(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid go attribute in \"tempile:params\" element: %s. file: %s line: %d col: %d",
+			err, paramsNode.Pos.FileName, paramsNode.Pos.Line, paramsNode.Pos.Column)
+	}
+
+	ctx.params = decls
+	return nil, nil
+}
+
+// splitParamDecls splits a Go parameter list like "user *User, items []Item"
+// into individual name/type pairs.
+func splitParamDecls(raw string) ([]paramDecl, error) {
+	var decls []paramDecl
+	for _, part := range splitTopLevel(raw) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		fields := strings.Fields(part)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed parameter declaration %q", part)
+		}
+
+		decls = append(decls, paramDecl{
+			Name: fields[0],
+			Type: strings.Join(fields[1:], " "),
+		})
+	}
+
+	if len(decls) == 0 {
+		return nil, errors.New("no parameters declared")
+	}
+	return decls, nil
+}
+
+// splitTopLevel splits s on commas that aren't nested inside (), [] or {},
+// so parameter types like "map[string]int" or "func(int, int) int" survive
+// intact.
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, s[start:])
+	return parts
+}
+
+// parseComponentCallNode compiles a "<Name/>"/"tempile:call" site into a
+// call to the matching "_component_<Name>" function. Attribute values are
+// resolved against the component's declared params, and any child content
+// supplied at the call site is compiled into a slot closure the component
+// body can invoke wherever it placed its "tempile:slot".
+func parseComponentCallNode(node tempilecore.Node, ctx *compileContext, impCtx *importCtx) (*codeChunk, error) {
+	callNode := node.(*tempilecore.ComponentCallNode)
+
+	decl, ok := ctx.components[callNode.Name]
+	if !ok {
+		return nil, fmt.Errorf("call to undefined component %q. file: %s line: %d col: %d",
+			callNode.Name, callNode.Pos.FileName, callNode.Pos.Line, callNode.Pos.Column)
+	}
+
+	if len(callNode.Childs) > 0 && !decl.HasSlot {
+		return nil, fmt.Errorf("component %q does not declare a \"tempile:slot\" to receive content. file: %s line: %d col: %d",
+			callNode.Name, callNode.Pos.FileName, callNode.Pos.Line, callNode.Pos.Column)
+	}
+
+	args, err := componentCallArgs(decl, callNode.Attrs, ctx, callNode.Pos)
+	if err != nil {
+		return nil, err
+	}
+
+	if decl.HasSlot {
+		slotChunks, err := parseChildNodes(callNode.Childs, ctx, impCtx)
+		if err != nil {
+			return nil, err
+		}
+		slotChunks = mergeWritableChunks(slotChunks)
+
+		for _, chunk := range slotChunks {
+			if chunk.Writable && chunk.NoMerge {
+				ctx.usedRuntime = true
+				break
+			}
+		}
+
+		args = append(args, fmt.Sprintf("func(w io.Writer) error {\nvar err error\n%s\nreturn err\n}",
+			renderPlainBody(slotChunks)))
+	}
+
+	return &codeChunk{
+		Writable: false,
+		Data:     fmt.Sprintf("if err = _component_%s(w, %s); err != nil { return err }\n", callNode.Name, strings.Join(args, ", ")),
+		Pos:      callNode.Pos,
+	}, nil
+}
+
+// componentCallArgs resolves one Go expression per declared param, in
+// declaration order, from the call site's attributes. An attribute present
+// on the call site that doesn't match any declared param is a compile
+// error, the same as a missing one, rather than being silently dropped.
+func componentCallArgs(decl *componentDecl, attrs []*tempilecore.Attribute, ctx *compileContext, pos tempilecore.Pos) ([]string, error) {
+	byName := make(map[string]*tempilecore.Attribute, len(attrs))
+	for _, a := range attrs {
+		byName[a.Name] = a
+	}
+
+	args := make([]string, len(decl.Params))
+	for i, p := range decl.Params {
+		a, ok := byName[p.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing attribute %q for component %q. file: %s line: %d col: %d",
+				p.Name, decl.Name, pos.FileName, pos.Line, pos.Column)
+		}
+		delete(byName, p.Name)
+
+		expr, err := componentAttrExpr(a, ctx)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = expr
+	}
+
+	for name := range byName {
+		return nil, fmt.Errorf("unknown attribute %q for component %q. file: %s line: %d col: %d",
+			name, decl.Name, pos.FileName, pos.Line, pos.Column)
+	}
+	return args, nil
+}
+
+// componentAttrExpr turns one component-call attribute into the Go
+// expression passed for the matching parameter: a single "{{ }}" expression
+// is forwarded as-is (preserving its own type, e.g. a *User), validated the
+// same way parseExprNode validates any other expression; a single plain
+// literal is a quoted Go string; anything mixing text and expressions (e.g.
+// title="Hi {{ user.Name }}") is concatenated into a string expression, the
+// same text-then-expr walk parseElementNode does for attribute values.
+func componentAttrExpr(a *tempilecore.Attribute, ctx *compileContext) (string, error) {
+	if len(a.ValueNodes) == 1 {
+		if exprNode, ok := a.ValueNodes[0].(*tempilecore.ExprNode); ok {
+			if err := validateGoExpr(exprNode.Expr, exprNode.Pos); err != nil {
+				return "", err
+			}
+			return exprNode.Expr, nil
+		}
+	}
+	if len(a.ValueNodes) <= 1 {
+		return strconv.Quote(a.Value), nil
+	}
+
+	var parts []string
+	for _, n := range a.ValueNodes {
+		switch n := n.(type) {
+		case *tempilecore.TextNode:
+			parts = append(parts, strconv.Quote(n.Data))
+		case *tempilecore.ExprNode:
+			if err := validateGoExpr(n.Expr, n.Pos); err != nil {
+				return "", err
+			}
+			ctx.usedFMT = true
+			parts = append(parts, fmt.Sprintf("fmt.Sprint(%s)", n.Expr))
+		}
+	}
+	return strings.Join(parts, " + "), nil
+}
+
+// parseSlotNode compiles a "tempile:slot" placeholder inside a component
+// body into a call to the caller-supplied slot closure, a no-op when the
+// caller didn't supply one.
+func parseSlotNode(node tempilecore.Node, ctx *compileContext) (*codeChunk, error) {
+	slotNode := node.(*tempilecore.SlotNode)
+
+	if !ctx.inComponentBody {
+		return nil, fmt.Errorf("\"tempile:slot\" is only valid inside a \"tempile:component\" body. file: %s line: %d col: %d",
+			slotNode.Pos.FileName, slotNode.Pos.Line, slotNode.Pos.Column)
+	}
+
+	return &codeChunk{
+		Writable: false,
+		Data:     "if tempileSlot != nil {\nif err = tempileSlot(w); err != nil { return err }\n}\n",
+		Pos:      slotNode.Pos,
+	}, nil
+}
+
+// renderPlainBody turns codeChunks into Go source the same way the main
+// template body does, except merged static text is written directly with
+// w.Write instead of being hoisted to a package-level fragment var: a slot
+// closure's content is specific to one call site, so there's nothing shared
+// across calls worth hoisting.
+func renderPlainBody(chunks []*codeChunk) string {
+	var b strings.Builder
+	for _, chunk := range chunks {
+		if chunk.Writable {
+			if chunk.NoMerge {
+				b.WriteString(fmt.Sprintf("if err = tempileruntime.WriteString(w, %s); err != nil { return err }\n", chunk.Data))
+			} else {
+				b.WriteString(fmt.Sprintf("if _, err = w.Write([]byte(%q)); err != nil { return err }\n", chunk.Data))
+			}
+		} else {
+			b.WriteString(chunk.Data)
+		}
+	}
+	return b.String()
+}
+
 func parseDocumentTypeNode(node tempilecore.Node) *codeChunk {
 	doctypeNode := node.(*tempilecore.DocumentTypeNode)
 	return &codeChunk{
 		Writable: true,
 		Data:     fmt.Sprintf("%s", doctypeNode.Data),
+		Pos:      doctypeNode.Pos,
 	}
 }
 
@@ -243,6 +937,7 @@ func parseCommentNode(node tempilecore.Node) *codeChunk {
 	return &codeChunk{
 		Writable: true,
 		Data:     fmt.Sprintf("%s", commentNode.Data),
+		Pos:      commentNode.Pos,
 	}
 }
 
@@ -251,6 +946,7 @@ func parseTextNode(node tempilecore.Node) *codeChunk {
 	return &codeChunk{
 		Writable: true,
 		Data:     fmt.Sprintf("%s", textNode.Data),
+		Pos:      textNode.Pos,
 	}
 }
 
@@ -264,6 +960,7 @@ func parseElementNode(node tempilecore.Node, ctx *compileContext, impCtx *import
 		chunks = append(chunks, &codeChunk{
 			Writable: true,
 			Data:     fmt.Sprintf("<%s", tag),
+			Pos:      elementNode.Pos,
 		})
 		for _, a := range elementNode.Attrs {
 			chunks = append(chunks, &codeChunk{
@@ -271,13 +968,21 @@ func parseElementNode(node tempilecore.Node, ctx *compileContext, impCtx *import
 				Data:     fmt.Sprintf(" %s=\"", a.Name),
 			})
 
+			ctx.pushEsc(attrEscContext(a.Name))
 			for _, n := range a.ValueNodes {
 				if n.Type() == tempilecore.NodeText {
 					chunks = append(chunks, parseTextNode(n))
 				} else if n.Type() == tempilecore.NodeExpr {
-					chunks = append(chunks, parseExprNode(n, ctx))
+					chunk, err := parseExprNode(n, ctx)
+					if err != nil {
+						ctx.popEsc()
+						return nil, err
+					}
+					chunks = append(chunks, chunk)
 				}
 			}
+			ctx.popEsc()
+
 			chunks = append(chunks, &codeChunk{
 				Writable: true,
 				Data:     "\"",
@@ -291,10 +996,15 @@ func parseElementNode(node tempilecore.Node, ctx *compileContext, impCtx *import
 		chunks = append(chunks, &codeChunk{
 			Writable: true,
 			Data:     fmt.Sprintf("<%s>", tag),
+			Pos:      elementNode.Pos,
 		})
 	}
 
+	pushed := pushBlockEscContext(ctx, tag)
 	childChunks, err := parseChildNodes(elementNode.Childs, ctx, impCtx)
+	if pushed {
+		ctx.popEsc()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -310,6 +1020,39 @@ func parseElementNode(node tempilecore.Node, ctx *compileContext, impCtx *import
 	return chunks, nil
 }
 
+// attrEscContext picks the escape context for an attribute's value based on
+// its name: URL-valued attributes and style="" need dedicated treatment,
+// everything else is a plain quoted attribute.
+func attrEscContext(name string) escContext {
+	switch {
+	case name == "srcset":
+		return escCtxSrcset
+	case urlAttrs[name]:
+		return escCtxURL
+	case name == "style":
+		return escCtxCSS
+	default:
+		return escCtxAttr
+	}
+}
+
+// pushBlockEscContext pushes the escape context that applies inside a
+// <script> or <style> element's children, reporting whether it pushed
+// anything (so the caller knows whether to pop). Other elements inherit
+// whatever context is already on the stack.
+func pushBlockEscContext(ctx *compileContext, tag string) bool {
+	switch tag {
+	case "script":
+		ctx.pushEsc(escCtxJS)
+		return true
+	case "style":
+		ctx.pushEsc(escCtxCSS)
+		return true
+	default:
+		return false
+	}
+}
+
 func parseIfNode(node tempilecore.Node, ctx *compileContext, impCtx *importCtx) ([]*codeChunk, error) {
 	ifNode := node.(*tempilecore.IfNode)
 	var chunks []*codeChunk
@@ -327,9 +1070,14 @@ func parseIfNode(node tempilecore.Node, ctx *compileContext, impCtx *importCtx)
 			ifNode.Pos.FileName, ifNode.Pos.Line, ifNode.Pos.Column)
 	}
 
+	if err := validateGoCond(cond, ifNode.Pos); err != nil {
+		return nil, err
+	}
+
 	chunks = append(chunks, &codeChunk{
 		Writable: false,
 		Data:     fmt.Sprintf("if %s {\n", cond),
+		Pos:      ifNode.Pos,
 	})
 
 	childChunks, err := parseChildNodes(ifNode.Then, ctx, impCtx)
@@ -353,7 +1101,7 @@ func parseIfNode(node tempilecore.Node, ctx *compileContext, impCtx *importCtx)
 	}
 
 	if ifNode.Else != nil {
-		elseNodeChunks, err := parseElseNode(ifNode.Else, ctx, impCtx)
+		elseNodeChunks, err := parseElseNode(ifNode.Else, ifNode.Pos, ctx, impCtx)
 		if err != nil {
 			return nil, err
 		}
@@ -385,9 +1133,14 @@ func parseElseIfNode(node tempilecore.Node, ctx *compileContext, impCtx *importC
 			elseIfNode.Pos.FileName, elseIfNode.Pos.Line, elseIfNode.Pos.Column)
 	}
 
+	if err := validateGoCond(cond, elseIfNode.Pos); err != nil {
+		return nil, err
+	}
+
 	chunks = append(chunks, &codeChunk{
 		Writable: false,
 		Data:     fmt.Sprintf("else if %s {\n", cond),
+		Pos:      elseIfNode.Pos,
 	})
 
 	childChunks, err := parseChildNodes(elseIfNode.Childs, ctx, impCtx)
@@ -403,7 +1156,7 @@ func parseElseIfNode(node tempilecore.Node, ctx *compileContext, impCtx *importC
 	return chunks, nil
 }
 
-func parseElseNode(node tempilecore.Node, ctx *compileContext, impCtx *importCtx) ([]*codeChunk, error) {
+func parseElseNode(node tempilecore.Node, pos tempilecore.Pos, ctx *compileContext, impCtx *importCtx) ([]*codeChunk, error) {
 	elseNode := node.(*tempilecore.ElseNode)
 
 	var chunks []*codeChunk
@@ -411,6 +1164,7 @@ func parseElseNode(node tempilecore.Node, ctx *compileContext, impCtx *importCtx
 	chunks = append(chunks, &codeChunk{
 		Writable: false,
 		Data:     "else {\n",
+		Pos:      pos,
 	})
 
 	childChunks, err := parseChildNodes(elseNode.Childs, ctx, impCtx)
@@ -443,9 +1197,14 @@ func parseForNode(node tempilecore.Node, ctx *compileContext, impCtx *importCtx)
 			forNode.Pos.FileName, forNode.Pos.Line, forNode.Pos.Column)
 	}
 
+	if err := validateGoLoop(loop, forNode.Pos); err != nil {
+		return nil, err
+	}
+
 	chunks = append(chunks, &codeChunk{
 		Writable: false,
 		Data:     fmt.Sprintf("for %s {\n", loop),
+		Pos:      forNode.Pos,
 	})
 
 	childChunks, err := parseChildNodes(forNode.Childs, ctx, impCtx)
@@ -474,35 +1233,85 @@ func parseChildNodes(childs []tempilecore.Node, ctx *compileContext, impCtx *imp
 	return chunks, nil
 }
 
-func parseExprNode(node tempilecore.Node, ctx *compileContext) *codeChunk {
+// rawHTMLSuffix opts an expression out of escaping, e.g. "{{ comment.HTML | rawhtml }}".
+const rawHTMLSuffix = "| rawhtml"
+
+func parseExprNode(node tempilecore.Node, ctx *compileContext) (*codeChunk, error) {
 	exprNode := node.(*tempilecore.ExprNode)
 
-	ctx.usedHTML = true
+	expr := exprNode.Expr
+	trimmed := strings.TrimSpace(expr)
+	raw := strings.TrimSpace(strings.TrimSuffix(trimmed, rawHTMLSuffix))
+	if strings.HasSuffix(trimmed, rawHTMLSuffix) {
+		if err := validateGoExpr(raw, exprNode.Pos); err != nil {
+			return nil, err
+		}
+
+		ctx.usedFMT = true
+		return &codeChunk{
+			Writable: true,
+			NoMerge:  true,
+			Data:     fmt.Sprintf("fmt.Sprint(%s)", raw),
+			Pos:      exprNode.Pos,
+		}, nil
+	}
+
+	if err := validateGoExpr(expr, exprNode.Pos); err != nil {
+		return nil, err
+	}
+
+	ctx.usedRuntime = true
+
+	if ctx.currentEsc() == escCtxJS {
+		return &codeChunk{
+			Writable: true,
+			NoMerge:  true,
+			Data:     fmt.Sprintf("tempileruntime.EscJS(%s)", expr),
+			Pos:      exprNode.Pos,
+		}, nil
+	}
+
 	ctx.usedFMT = true
+	helper := map[escContext]string{
+		escCtxHTML:   "EscHTML",
+		escCtxAttr:   "EscAttr",
+		escCtxURL:    "EscURL",
+		escCtxSrcset: "EscSrcset",
+		escCtxCSS:    "EscCSS",
+	}[ctx.currentEsc()]
 
 	return &codeChunk{
 		Writable: true,
 		NoMerge:  true,
-		Data:     fmt.Sprintf("html.EscapeString(fmt.Sprint(%s))", exprNode.Expr),
-	}
+		Data:     fmt.Sprintf("tempileruntime.%s(fmt.Sprint(%s))", helper, expr),
+		Pos:      exprNode.Pos,
+	}, nil
 }
 
-func parseRawCodeNode(node tempilecore.Node) *codeChunk {
+func parseRawCodeNode(node tempilecore.Node) (*codeChunk, error) {
 	rawCodeNode := node.(*tempilecore.RawCodeNode)
 	if rawCodeNode.Lang == "go" {
+		if err := validateGoCode(rawCodeNode.Code, rawCodeNode.Pos); err != nil {
+			return nil, err
+		}
 		return &codeChunk{
 			Writable: false,
 			Data:     fmt.Sprintf("%s\n", rawCodeNode.Code),
-		}
+			Pos:      rawCodeNode.Pos,
+		}, nil
 	}
-	return nil
+	return nil, nil
 }
 
-func parseRawExprNode(node tempilecore.Node) *codeChunk {
+func parseRawExprNode(node tempilecore.Node) (*codeChunk, error) {
 	rawExprNode := node.(*tempilecore.RawExprNode)
+	if err := validateGoExpr(rawExprNode.Expr, rawExprNode.Pos); err != nil {
+		return nil, err
+	}
 	return &codeChunk{
 		Writable: true,
 		NoMerge:  true,
 		Data:     rawExprNode.Expr,
-	}
+		Pos:      rawExprNode.Pos,
+	}, nil
 }
@@ -27,6 +27,114 @@ func TestCompileSimpleElement(t *testing.T) {
 	}
 }
 
+func TestCompileHoistsStaticFragments(t *testing.T) {
+	src := `<div>Hello World</div>`
+
+	options := &CompileOptions{
+		PackageName:  "main",
+		TemplateName: "Render",
+		FileName:     "simple.html",
+		SrcPath:      "./",
+	}
+
+	code, err := Compile(src, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(code, `var _frag_Render_0 = []byte("<div>Hello World</div>")`) {
+		t.Fatalf("expected hoisted package-level fragment var, got:\n%s", code)
+	}
+	if !strings.Contains(code, "w.Write(_frag_Render_0)") {
+		t.Fatalf("expected generated code to write the hoisted fragment, got:\n%s", code)
+	}
+}
+
+func TestCompileWithSourceMap(t *testing.T) {
+	src := `<div>{{data.Name}}</div>`
+
+	options := &CompileOptions{
+		PackageName:  "main",
+		TemplateName: "Render",
+		FileName:     "simple.html",
+		SrcPath:      "./",
+	}
+
+	code, sm, err := CompileWithSourceMap(src, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm == nil {
+		t.Fatal("expected a non-nil source map")
+	}
+	if !strings.Contains(code, "//line simple.html:") {
+		t.Fatalf("expected generated code to carry //line directives, got:\n%s", code)
+	}
+
+	found := false
+	for genLine := 1; genLine <= strings.Count(code, "\n")+1; genLine++ {
+		if pos, ok := sm.Lookup(genLine); ok && pos.FileName == "simple.html" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("expected at least one source map entry pointing back to simple.html")
+	}
+}
+
+func TestCompileIfElseIf(t *testing.T) {
+	src := `<tempile:params go="flag bool, other bool"/>` +
+		`<if go-cond="flag">Yes<elseif go-cond="other">Maybe<else>No</if>`
+
+	options := &CompileOptions{
+		PackageName:  "main",
+		TemplateName: "Render",
+		FileName:     "simple.html",
+		SrcPath:      "./",
+	}
+
+	code, err := Compile(src, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(code, "} else if other {") {
+		t.Fatalf("expected \"} else if\" to stay on one line, got:\n%s", code)
+	}
+	if !strings.Contains(code, "} else {") {
+		t.Fatalf("expected \"} else {\" to stay on one line, got:\n%s", code)
+	}
+}
+
+func TestSourceMapLookupMiss(t *testing.T) {
+	sm := &SourceMap{entries: map[int]tempilecore.Pos{}}
+	if _, ok := sm.Lookup(1); ok {
+		t.Fatal("expected lookup on empty source map to miss")
+	}
+}
+
+func TestCompileFragmentPrefixAvoidsCollisions(t *testing.T) {
+	src := `<div>Hello World</div>`
+
+	options := &CompileOptions{
+		PackageName:    "main",
+		TemplateName:   "Render",
+		FileName:       "simple.html",
+		SrcPath:        "./",
+		FragmentPrefix: "Card",
+	}
+
+	code, err := Compile(src, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(code, "_frag_CardRender_0") {
+		t.Fatalf("expected FragmentPrefix to namespace the fragment var, got:\n%s", code)
+	}
+}
+
 func TestParseTextNode(t *testing.T) {
 	node := &tempilecore.TextNode{Data: "Hello"}
 	chunk := parseTextNode(node)
@@ -37,16 +145,79 @@ func TestParseTextNode(t *testing.T) {
 
 func TestParseExprNode(t *testing.T) {
 	node := &tempilecore.ExprNode{Expr: "data.Name"}
-	chunk := parseExprNode(node, &compileContext{})
-	expected := "html.EscapeString(fmt.Sprint(data.Name))"
+	chunk, err := parseExprNode(node, &compileContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "tempileruntime.EscHTML(fmt.Sprint(data.Name))"
+	if chunk.Data != expected {
+		t.Fatalf("expected %q, got %q", expected, chunk.Data)
+	}
+}
+
+func TestParseExprNodeInvalidExpr(t *testing.T) {
+	node := &tempilecore.ExprNode{Expr: "data.(", Pos: tempilecore.Pos{FileName: "t.html", Line: 3, Column: 5}}
+	_, err := parseExprNode(node, &compileContext{})
+	if err == nil {
+		t.Fatal("expected an error for an invalid Go expression")
+	}
+	if !strings.Contains(err.Error(), "t.html:3:") {
+		t.Fatalf("expected error to reference the template position, got: %v", err)
+	}
+}
+
+func TestParseExprNodeContexts(t *testing.T) {
+	tests := []struct {
+		name     string
+		esc      escContext
+		expected string
+	}{
+		{"html", escCtxHTML, "tempileruntime.EscHTML(fmt.Sprint(data.Name))"},
+		{"attr", escCtxAttr, "tempileruntime.EscAttr(fmt.Sprint(data.Name))"},
+		{"url", escCtxURL, "tempileruntime.EscURL(fmt.Sprint(data.Name))"},
+		{"css", escCtxCSS, "tempileruntime.EscCSS(fmt.Sprint(data.Name))"},
+		{"js", escCtxJS, "tempileruntime.EscJS(data.Name)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &compileContext{}
+			if tt.esc != escCtxHTML {
+				ctx.pushEsc(tt.esc)
+			}
+			chunk, err := parseExprNode(&tempilecore.ExprNode{Expr: "data.Name"}, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chunk.Data != tt.expected {
+				t.Fatalf("expected %q, got %q", tt.expected, chunk.Data)
+			}
+		})
+	}
+}
+
+func TestParseExprNodeRawHTMLBypass(t *testing.T) {
+	ctx := &compileContext{}
+	ctx.pushEsc(escCtxAttr)
+	chunk, err := parseExprNode(&tempilecore.ExprNode{Expr: "comment.HTML | rawhtml"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "fmt.Sprint(comment.HTML)"
 	if chunk.Data != expected {
 		t.Fatalf("expected %q, got %q", expected, chunk.Data)
 	}
+	if ctx.usedRuntime {
+		t.Fatalf("rawhtml bypass should not mark the runtime helper package as used")
+	}
 }
 
 func TestParseRawExprNode(t *testing.T) {
 	node := &tempilecore.RawExprNode{Expr: "fmt.Println(\"x\")"}
-	chunk := parseRawExprNode(node)
+	chunk, err := parseRawExprNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !chunk.Writable || chunk.Data != "fmt.Println(\"x\")" {
 		t.Fatalf("unexpected RawExprNode chunk: %+v", chunk)
 	}
@@ -54,12 +225,30 @@ func TestParseRawExprNode(t *testing.T) {
 
 func TestParseRawCodeNode(t *testing.T) {
 	node := &tempilecore.RawCodeNode{Lang: "go", Code: "var x = 5"}
-	chunk := parseRawCodeNode(node)
+	chunk, err := parseRawCodeNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if chunk.Data != "var x = 5\n" {
 		t.Fatalf("unexpected RawCodeNode chunk: %+v", chunk)
 	}
 }
 
+func TestParseForNodeInvalidLoop(t *testing.T) {
+	forNode := &tempilecore.ForNode{
+		Loops: []*tempilecore.Attribute{
+			{Name: "go-loop", Value: "i := range"},
+		},
+		Childs: []tempilecore.Node{&tempilecore.TextNode{Data: "Item"}},
+		Pos:    tempilecore.Pos{FileName: "t.html", Line: 2, Column: 1},
+	}
+
+	_, err := parseForNode(forNode, &compileContext{}, &importCtx{})
+	if err == nil {
+		t.Fatal("expected an error for an invalid go-loop clause")
+	}
+}
+
 func TestMergeWritableChunks(t *testing.T) {
 	chunks := []*codeChunk{
 		{Writable: true, Data: "a"},
@@ -100,7 +289,7 @@ func TestParseIfNode(t *testing.T) {
 		Pos: tempilecore.Pos{FileName: "test.html", Line: 1},
 	}
 
-	chunks, err := parseIfNode(ifNode, &compileContext{})
+	chunks, err := parseIfNode(ifNode, &compileContext{}, &importCtx{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,7 +321,7 @@ func TestParseForNode(t *testing.T) {
 		Pos: tempilecore.Pos{FileName: "test.html", Line: 1},
 	}
 
-	chunks, err := parseForNode(forNode, &compileContext{})
+	chunks, err := parseForNode(forNode, &compileContext{}, &importCtx{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -159,7 +348,7 @@ func TestParseChildNodes(t *testing.T) {
 		&tempilecore.ExprNode{Expr: "data.Name"},
 	}
 
-	chunks, err := parseChildNodes(nodes, &compileContext{})
+	chunks, err := parseChildNodes(nodes, &compileContext{}, &importCtx{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -172,7 +361,7 @@ func TestParseChildNodes(t *testing.T) {
 		t.Errorf("first chunk incorrect: %+v", chunks[0])
 	}
 
-	expected := "html.EscapeString(fmt.Sprint(data.Name))"
+	expected := "tempileruntime.EscHTML(fmt.Sprint(data.Name))"
 	if chunks[1].Data != expected || !chunks[1].Writable || !chunks[1].NoMerge {
 		t.Errorf("second chunk incorrect: %+v", chunks[1])
 	}
@@ -197,7 +386,7 @@ func TestParseElementNodeWithAttrAndExpr(t *testing.T) {
 		},
 	}
 
-	chunks, err := parseElementNode(node, &compileContext{})
+	chunks, err := parseElementNode(node, &compileContext{}, &importCtx{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -212,9 +401,9 @@ func TestParseElementNodeWithAttrAndExpr(t *testing.T) {
 	expectedParts := []string{
 		`<div class="`,
 		`container`,
-		`html.EscapeString(fmt.Sprint(data.Class))`,
+		`tempileruntime.EscAttr(fmt.Sprint(data.Class))`,
 		`">Hello`,
-		`html.EscapeString(fmt.Sprint(data.Name))`,
+		`tempileruntime.EscHTML(fmt.Sprint(data.Name))`,
 		`</div>`,
 	}
 
@@ -224,3 +413,353 @@ func TestParseElementNodeWithAttrAndExpr(t *testing.T) {
 		}
 	}
 }
+
+func TestParseElementNodeURLAttr(t *testing.T) {
+	node := &tempilecore.ElementNode{
+		Tag: "a",
+		Attrs: []*tempilecore.Attribute{
+			{
+				Name: "href",
+				ValueNodes: []tempilecore.Node{
+					&tempilecore.ExprNode{Expr: "url"},
+				},
+			},
+		},
+	}
+
+	chunks, err := parseElementNode(node, &compileContext{}, &importCtx{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := ""
+	for _, c := range chunks {
+		code += c.Data
+	}
+
+	if !strings.Contains(code, "tempileruntime.EscURL(fmt.Sprint(url))") {
+		t.Fatalf("expected href value to go through EscURL, got:\n%s", code)
+	}
+}
+
+func TestParseElementNodeSrcsetAttr(t *testing.T) {
+	node := &tempilecore.ElementNode{
+		Tag: "img",
+		Attrs: []*tempilecore.Attribute{
+			{
+				Name: "srcset",
+				ValueNodes: []tempilecore.Node{
+					&tempilecore.ExprNode{Expr: "candidates"},
+				},
+			},
+		},
+	}
+
+	chunks, err := parseElementNode(node, &compileContext{}, &importCtx{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := ""
+	for _, c := range chunks {
+		code += c.Data
+	}
+
+	if !strings.Contains(code, "tempileruntime.EscSrcset(fmt.Sprint(candidates))") {
+		t.Fatalf("expected srcset value to go through EscSrcset rather than EscURL, got:\n%s", code)
+	}
+}
+
+func TestParseElementNodeStyleAttr(t *testing.T) {
+	node := &tempilecore.ElementNode{
+		Tag: "div",
+		Attrs: []*tempilecore.Attribute{
+			{
+				Name: "style",
+				ValueNodes: []tempilecore.Node{
+					&tempilecore.ExprNode{Expr: "color"},
+				},
+			},
+		},
+	}
+
+	chunks, err := parseElementNode(node, &compileContext{}, &importCtx{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := ""
+	for _, c := range chunks {
+		code += c.Data
+	}
+
+	if !strings.Contains(code, "tempileruntime.EscCSS(fmt.Sprint(color))") {
+		t.Fatalf("expected style attr value to go through EscCSS, got:\n%s", code)
+	}
+}
+
+func TestParseElementNodeScriptJS(t *testing.T) {
+	node := &tempilecore.ElementNode{
+		Tag: "script",
+		Childs: []tempilecore.Node{
+			&tempilecore.TextNode{Data: "var x = "},
+			&tempilecore.ExprNode{Expr: "v"},
+		},
+	}
+
+	chunks, err := parseElementNode(node, &compileContext{}, &importCtx{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := ""
+	for _, c := range chunks {
+		code += c.Data
+	}
+
+	if !strings.Contains(code, "tempileruntime.EscJS(v)") {
+		t.Fatalf("expected script expression to go through EscJS, got:\n%s", code)
+	}
+}
+
+func TestParseParamsNode(t *testing.T) {
+	node := &tempilecore.ParamsNode{
+		Attrs: []*tempilecore.Attribute{
+			{Name: "go", Value: "user *User, items []Item, now time.Time"},
+		},
+	}
+
+	ctx := &compileContext{}
+	chunk, err := parseParamsNode(node, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunk != nil {
+		t.Fatalf("expected no codeChunk from a params directive, got %+v", chunk)
+	}
+
+	if !ctx.hasParams() {
+		t.Fatal("expected ctx.hasParams() to be true after a params directive")
+	}
+
+	want := []paramDecl{
+		{Name: "user", Type: "*User"},
+		{Name: "items", Type: "[]Item"},
+		{Name: "now", Type: "time.Time"},
+	}
+	if len(ctx.params) != len(want) {
+		t.Fatalf("expected %d params, got %d: %+v", len(want), len(ctx.params), ctx.params)
+	}
+	for i, p := range want {
+		if ctx.params[i] != p {
+			t.Errorf("param %d: expected %+v, got %+v", i, p, ctx.params[i])
+		}
+	}
+}
+
+func TestParseParamsNodeMissingGo(t *testing.T) {
+	node := &tempilecore.ParamsNode{Pos: tempilecore.Pos{FileName: "t.html", Line: 1, Column: 1}}
+	_, err := parseParamsNode(node, &compileContext{})
+	if err == nil {
+		t.Fatal("expected an error when the go attribute is missing")
+	}
+}
+
+func TestParseParamsNodeInvalidGo(t *testing.T) {
+	node := &tempilecore.ParamsNode{
+		Attrs: []*tempilecore.Attribute{
+			{Name: "go", Value: "user *User,"},
+		},
+		Pos: tempilecore.Pos{FileName: "t.html", Line: 1, Column: 1},
+	}
+	_, err := parseParamsNode(node, &compileContext{})
+	if err == nil {
+		t.Fatal("expected an error for a malformed go attribute")
+	}
+}
+
+func TestCompileWithTypedParams(t *testing.T) {
+	src := `<tempile:params go="user *User"/><div>{{user.Name}}</div>`
+
+	options := &CompileOptions{
+		PackageName:  "main",
+		TemplateName: "Render",
+		FileName:     "simple.html",
+		SrcPath:      "./",
+	}
+
+	code, err := Compile(src, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(code, "func Render(w io.Writer, user *User) error") {
+		t.Fatalf("expected typed Render signature, got:\n%s", code)
+	}
+	if !strings.Contains(code, "type RenderParams struct") || !strings.Contains(code, "User *User") {
+		t.Fatalf("expected a RenderParams struct, got:\n%s", code)
+	}
+	if !strings.Contains(code, "func RenderWithParams(w io.Writer, p RenderParams) error") ||
+		!strings.Contains(code, "return Render(w, p.User)") {
+		t.Fatalf("expected a RenderWithParams wrapper, got:\n%s", code)
+	}
+}
+
+func TestCollectComponentsDuplicate(t *testing.T) {
+	nodes := []tempilecore.Node{
+		&tempilecore.ComponentNode{Name: "Card", Pos: tempilecore.Pos{FileName: "t.html", Line: 1, Column: 1}},
+		&tempilecore.ComponentNode{Name: "Card", Pos: tempilecore.Pos{FileName: "t.html", Line: 5, Column: 1}},
+	}
+
+	err := collectComponents(nodes, &compileContext{})
+	if err == nil {
+		t.Fatal("expected an error for a duplicate component name")
+	}
+	if !strings.Contains(err.Error(), "line: 5") {
+		t.Fatalf("expected the error to point at the second definition, got: %s", err)
+	}
+}
+
+func TestParseComponentCallNodeUndefined(t *testing.T) {
+	node := &tempilecore.ComponentCallNode{
+		Name: "Missing",
+		Pos:  tempilecore.Pos{FileName: "t.html", Line: 1, Column: 1},
+	}
+
+	_, err := parseComponentCallNode(node, &compileContext{}, &importCtx{})
+	if err == nil {
+		t.Fatal("expected an error for a call to an undefined component")
+	}
+}
+
+func TestParseSlotNodeOutsideComponent(t *testing.T) {
+	node := &tempilecore.SlotNode{Pos: tempilecore.Pos{FileName: "t.html", Line: 1, Column: 1}}
+
+	_, err := parseSlotNode(node, &compileContext{})
+	if err == nil {
+		t.Fatal("expected an error for a slot placeholder outside a component body")
+	}
+}
+
+func TestCompileWithComponent(t *testing.T) {
+	src := `<tempile:component name="Card" params="title string">` +
+		`<div class="card"><h1>{{title}}</h1><tempile:slot/></div>` +
+		`</tempile:component>` +
+		`<Card title="Hello"><p>Body</p></Card>`
+
+	options := &CompileOptions{
+		PackageName:  "main",
+		TemplateName: "Render",
+		FileName:     "simple.html",
+		SrcPath:      "./",
+	}
+
+	code, err := Compile(src, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(code, "func _component_Card(w io.Writer, title string, tempileSlot func(io.Writer) error) error") {
+		t.Fatalf("expected a generated _component_Card function, got:\n%s", code)
+	}
+	if !strings.Contains(code, "_component_Card(w,") {
+		t.Fatalf("expected the call site to invoke _component_Card, got:\n%s", code)
+	}
+	if !strings.Contains(code, "if tempileSlot != nil {") {
+		t.Fatalf("expected the slot placeholder to guard a nil slot closure, got:\n%s", code)
+	}
+}
+
+func TestParseComponentCallNodeSlotSetsUsedRuntime(t *testing.T) {
+	ctx := &compileContext{
+		components: map[string]*componentDecl{
+			"Card": {Name: "Card", HasSlot: true},
+		},
+	}
+	node := &tempilecore.ComponentCallNode{
+		Name: "Card",
+		Childs: []tempilecore.Node{
+			&tempilecore.RawExprNode{Expr: "comment.HTML"},
+		},
+		Pos: tempilecore.Pos{FileName: "t.html", Line: 1, Column: 1},
+	}
+
+	if _, err := parseComponentCallNode(node, ctx, &importCtx{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ctx.usedRuntime {
+		t.Fatal("expected a NoMerge chunk inside a slot closure to mark the runtime helper package as used")
+	}
+}
+
+func TestCompileComponentCallMissingSlot(t *testing.T) {
+	src := `<tempile:component name="Card" params="title string">` +
+		`<div>{{title}}</div>` +
+		`</tempile:component>` +
+		`<Card title="Hello"><p>Body</p></Card>`
+
+	options := &CompileOptions{
+		PackageName:  "main",
+		TemplateName: "Render",
+		FileName:     "simple.html",
+		SrcPath:      "./",
+	}
+
+	if _, err := Compile(src, options); err == nil {
+		t.Fatal("expected an error when a call supplies content but the component declares no slot")
+	}
+}
+
+func TestComponentAttrExprMixedContent(t *testing.T) {
+	attr := &tempilecore.Attribute{
+		Name: "title",
+		ValueNodes: []tempilecore.Node{
+			&tempilecore.TextNode{Data: "Hi "},
+			&tempilecore.ExprNode{Expr: "user.Name"},
+		},
+	}
+
+	ctx := &compileContext{}
+	expr, err := componentAttrExpr(attr, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `"Hi " + fmt.Sprint(user.Name)`
+	if expr != want {
+		t.Fatalf("expected %q, got %q", want, expr)
+	}
+	if !ctx.usedFMT {
+		t.Fatal("expected usedFMT to be set for a mixed-content attribute")
+	}
+}
+
+func TestComponentCallArgsUnknownAttribute(t *testing.T) {
+	decl := &componentDecl{
+		Name:   "Card",
+		Params: []paramDecl{{Name: "title", Type: "string"}},
+	}
+	attrs := []*tempilecore.Attribute{
+		{Name: "title", Value: "Hello"},
+		{Name: "subtitle", Value: "x"},
+	}
+
+	_, err := componentCallArgs(decl, attrs, &compileContext{}, tempilecore.Pos{FileName: "t.html", Line: 1, Column: 1})
+	if err == nil {
+		t.Fatal("expected an error for an attribute not declared on the component")
+	}
+}
+
+func TestContainsSlotForwardedThroughComponentCall(t *testing.T) {
+	nodes := []tempilecore.Node{
+		&tempilecore.ComponentCallNode{
+			Name:   "B",
+			Childs: []tempilecore.Node{&tempilecore.SlotNode{}},
+		},
+	}
+
+	if !containsSlot(nodes) {
+		t.Fatal("expected a slot forwarded into a nested component call to be detected")
+	}
+}
@@ -0,0 +1,84 @@
+package tempilegocompiler
+
+import (
+	"fmt"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+
+	tempilecore "github.com/gokhanaltun/tempile-core"
+)
+
+// validateGoExpr checks that expr parses as a standalone Go expression,
+// translating any parse error back to the template position it came from.
+// Used for ExprNode and RawExprNode fragments.
+func validateGoExpr(expr string, pos tempilecore.Pos) error {
+	fset := token.NewFileSet()
+	if _, err := parser.ParseExprFrom(fset, "", expr, 0); err != nil {
+		return translateParseError(err, pos, 1, 1)
+	}
+	return nil
+}
+
+// validateGoCond checks a go-cond fragment by parsing it as the condition of
+// an "if" statement.
+func validateGoCond(cond string, pos tempilecore.Pos) error {
+	return validateGoStmt(fmt.Sprintf("if %s {\n}", cond), pos, len("if ")+1)
+}
+
+// validateGoLoop checks a go-loop fragment by parsing it as the clause of a
+// "for" statement.
+func validateGoLoop(loop string, pos tempilecore.Pos) error {
+	return validateGoStmt(fmt.Sprintf("for %s {\n}", loop), pos, len("for ")+1)
+}
+
+// validateGoCode checks a RawCodeNode's body by parsing it as a function body.
+func validateGoCode(code string, pos tempilecore.Pos) error {
+	return validateGoStmt(code, pos, 1)
+}
+
+// validateGoParams checks a "tempile:params" go attribute by parsing it as
+// the parameter list of a function declaration.
+func validateGoParams(params string, pos tempilecore.Pos) error {
+	src := fmt.Sprintf("package p\nfunc _(%s) {}\n", params)
+
+	fset := token.NewFileSet()
+	if _, err := parser.ParseFile(fset, "", src, 0); err != nil {
+		return translateParseError(err, pos, 2, len("func _(")+1)
+	}
+	return nil
+}
+
+// validateGoStmt wraps stmt in a synthetic function so go/parser can check it
+// as a full statement, then translates any error's position back to pos.
+// fragCol is the column the template's own fragment starts on inside that
+// synthetic function body (e.g. 4 when stmt wraps it as "if <cond> {").
+func validateGoStmt(stmt string, pos tempilecore.Pos, fragCol int) error {
+	src := fmt.Sprintf("package p\nfunc _() {\n%s\n}\n", stmt)
+
+	fset := token.NewFileSet()
+	if _, err := parser.ParseFile(fset, "", src, 0); err != nil {
+		return translateParseError(err, pos, 3, fragCol)
+	}
+	return nil
+}
+
+// translateParseError rewrites a go/parser error, whose position is relative
+// to a synthetic source fragment, into one relative to pos: the location of
+// that fragment in the original template. fragLine/fragCol is where the
+// fragment's own text starts within the synthetic source.
+func translateParseError(err error, pos tempilecore.Pos, fragLine, fragCol int) error {
+	list, ok := err.(scanner.ErrorList)
+	if !ok || len(list) == 0 {
+		return fmt.Errorf("%s:%d:%d: invalid Go expression: %s", pos.FileName, pos.Line, pos.Column, err)
+	}
+
+	first := list[0]
+	line := pos.Line + (first.Pos.Line - fragLine)
+	col := first.Pos.Column
+	if first.Pos.Line == fragLine {
+		col = pos.Column + (first.Pos.Column - fragCol)
+	}
+
+	return fmt.Errorf("%s:%d:%d: invalid Go expression: %s", pos.FileName, line, col, first.Msg)
+}
@@ -0,0 +1,154 @@
+// Package tempileruntime holds the small helper functions that compiled
+// templates call into at render time. It is kept separate from the compiler
+// package so generated code only pulls in exactly the helpers it uses.
+package tempileruntime
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// WriteString writes s to w, using w's WriteString method directly when it
+// has one (e.g. *bufio.Writer, http.ResponseWriter) instead of round-tripping
+// through a []byte conversion.
+func WriteString(w io.Writer, s string) error {
+	if sw, ok := w.(io.StringWriter); ok {
+		_, err := sw.WriteString(s)
+		return err
+	}
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+// EscHTML escapes a value for use in an HTML text node.
+func EscHTML(s string) string {
+	return html.EscapeString(s)
+}
+
+// EscAttr escapes a value for use inside a quoted HTML attribute.
+func EscAttr(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '"':
+			b.WriteString("&#34;")
+		case '\'':
+			b.WriteString("&#39;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// safeURLSchemes are the schemes allowed through EscURL unaltered. Anything
+// else (most notably javascript:) is replaced with a harmless placeholder.
+var safeURLSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+	"tel":    true,
+}
+
+// urlSafeBytes are left untouched by EscURL; everything else is
+// percent-encoded.
+const urlSafeBytes = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.~:/?#[]@!$&'()*+,;=%"
+
+// EscURL sanitizes a value for use in a single-URL attribute (href, src,
+// action, formaction, xlink:href). A scheme outside the allowlist is
+// replaced wholesale; remaining bytes outside the unreserved/structural set
+// are percent-encoded. srcset holds a list of URLs, not one; use EscSrcset
+// for that attribute instead.
+func EscURL(s string) string {
+	if scheme, ok := urlScheme(s); ok && !safeURLSchemes[strings.ToLower(scheme)] {
+		return "about:invalid#tempile"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if strings.IndexByte(urlSafeBytes, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// EscSrcset sanitizes a value for use in the srcset attribute. Unlike the
+// other URL-valued attributes, srcset is a comma-separated list of
+// "<url> <descriptor>" candidates (e.g. "a.jpg 1x, b.jpg 2x"), so running it
+// through EscURL as a single value would percent-encode the spaces and
+// commas that hold the list together. Each candidate's URL portion is
+// escaped with EscURL; its descriptor is escaped with EscAttr, since it
+// still lands inside the same quoted attribute and could otherwise break
+// out of it (e.g. a descriptor of `1x" onerror="alert(1)`).
+func EscSrcset(s string) string {
+	candidates := strings.Split(s, ",")
+	for i, c := range candidates {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			candidates[i] = ""
+			continue
+		}
+		parts := strings.SplitN(c, " ", 2)
+		parts[0] = EscURL(parts[0])
+		if len(parts) > 1 {
+			parts[1] = EscAttr(parts[1])
+		}
+		candidates[i] = strings.Join(parts, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// urlScheme returns the scheme prefix of s (e.g. "javascript" out of
+// "javascript:alert(1)"), if s looks like it has one.
+func urlScheme(s string) (string, bool) {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return "", false
+	}
+	if strings.ContainsAny(s[:i], "/?#") {
+		return "", false
+	}
+	return s[:i], true
+}
+
+// EscJS renders v as a JSON literal safe to embed inside a <script> block.
+// Bytes that could close a </script> tag early are additionally escaped.
+func EscJS(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+
+	s := string(b)
+	s = strings.ReplaceAll(s, "<", `\u003c`)
+	s = strings.ReplaceAll(s, ">", `\u003e`)
+	s = strings.ReplaceAll(s, "&", `\u0026`)
+	return s
+}
+
+// EscCSS escapes a value for use inside a <style> block or a style="" attribute,
+// allowing only alphanumerics through unescaped.
+func EscCSS(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			continue
+		}
+		fmt.Fprintf(&b, `\%x `, r)
+	}
+	return b.String()
+}
@@ -0,0 +1,18 @@
+package tempileruntime
+
+import "testing"
+
+func TestEscSrcsetEscapesDescriptorBreakout(t *testing.T) {
+	got := EscSrcset(`x.jpg 1x" onerror="alert(1)`)
+	if got != `x.jpg 1x&#34; onerror=&#34;alert(1)` {
+		t.Fatalf("expected the descriptor's quote to be escaped, got %q", got)
+	}
+}
+
+func TestEscSrcsetKeepsCandidateSeparators(t *testing.T) {
+	got := EscSrcset("a.jpg 1x, b.jpg 2x")
+	want := "a.jpg 1x, b.jpg 2x"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}